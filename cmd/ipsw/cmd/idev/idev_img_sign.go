@@ -22,6 +22,7 @@ THE SOFTWARE.
 package idev
 
 import (
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"os"
@@ -32,6 +33,9 @@ import (
 	"github.com/blacktop/ipsw/internal/utils"
 	"github.com/blacktop/ipsw/pkg/plist"
 	"github.com/blacktop/ipsw/pkg/tss"
+	"github.com/blacktop/ipsw/pkg/usb"
+	"github.com/blacktop/ipsw/pkg/usb/lockdownd"
+	"github.com/blacktop/ipsw/pkg/usb/mobileimagemounter"
 	"github.com/fatih/color"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -42,6 +46,7 @@ func init() {
 
 	idevImgSignCmd.Flags().StringP("xcode", "x", "/Applications/Xcode.app", "Path to Xcode.app")
 	idevImgSignCmd.Flags().StringP("manifest", "m", "", "BuildManifest.plist to use")
+	idevImgSignCmd.Flags().StringP("udid", "u", "", "Device UDID to personalize for (auto-discovers board-id/chip-id/ecid/nonce)")
 	idevImgSignCmd.Flags().Uint64P("board-id", "b", 0, "Device ApBoardID")
 	idevImgSignCmd.Flags().Uint64P("chip-id", "c", 0, "Device ApChipID")
 	idevImgSignCmd.Flags().Uint64P("ecid", "e", 0, "Device ApECID")
@@ -50,9 +55,14 @@ func init() {
 	idevImgSignCmd.Flags().Bool("insecure", false, "do not verify ssl certs")
 	idevImgSignCmd.Flags().StringP("output", "o", "", "Folder to write signature to")
 	idevImgSignCmd.MarkFlagDirname("output")
+	idevImgSignCmd.Flags().Bool("no-mount", false, "only personalize the DDI, do not mount it on the device")
+	idevImgSignCmd.Flags().Bool("refresh", false, "ignore any cached TSS ticket and re-personalize")
+	idevImgSignCmd.Flags().String("devices", "", "YAML/JSON file listing devices to batch personalize")
+	idevImgSignCmd.MarkFlagFilename("devices")
 
 	viper.BindPFlag("idev.img.sign.xcode", idevImgSignCmd.Flags().Lookup("xcode"))
 	viper.BindPFlag("idev.img.sign.manifest", idevImgSignCmd.Flags().Lookup("manifest"))
+	viper.BindPFlag("idev.img.sign.udid", idevImgSignCmd.Flags().Lookup("udid"))
 	viper.BindPFlag("idev.img.sign.board-id", idevImgSignCmd.Flags().Lookup("board-id"))
 	viper.BindPFlag("idev.img.sign.chip-id", idevImgSignCmd.Flags().Lookup("chip-id"))
 	viper.BindPFlag("idev.img.sign.ecid", idevImgSignCmd.Flags().Lookup("ecid"))
@@ -60,6 +70,150 @@ func init() {
 	viper.BindPFlag("idev.img.sign.output", idevImgSignCmd.Flags().Lookup("output"))
 	viper.BindPFlag("idev.img.sign.proxy", idevImgSignCmd.Flags().Lookup("proxy"))
 	viper.BindPFlag("idev.img.sign.insecure", idevImgSignCmd.Flags().Lookup("insecure"))
+	viper.BindPFlag("idev.img.sign.no-mount", idevImgSignCmd.Flags().Lookup("no-mount"))
+	viper.BindPFlag("idev.img.sign.refresh", idevImgSignCmd.Flags().Lookup("refresh"))
+	viper.BindPFlag("idev.img.sign.devices", idevImgSignCmd.Flags().Lookup("devices"))
+}
+
+// queryDevicePersonalization asks lockdownd and the image-mounter service running on
+// the device identified by udid for the ApBoardID, ApChipID, ApECID and a freshly
+// generated ApNonce, so the caller doesn't have to supply them by hand.
+func queryDevicePersonalization(udid string) (boardID, chipID, ecid uint64, nonce string, err error) {
+	lc, err := lockdownd.NewClient(udid)
+	if err != nil {
+		return 0, 0, 0, "", fmt.Errorf("failed to connect to lockdownd: %w", err)
+	}
+	defer lc.Close()
+
+	boardID, err = lc.GetValueUint64("ApBoardID", "BoardId")
+	if err != nil {
+		return 0, 0, 0, "", fmt.Errorf("failed to read BoardId from lockdownd: %w", err)
+	}
+	chipID, err = lc.GetValueUint64("ChipID")
+	if err != nil {
+		return 0, 0, 0, "", fmt.Errorf("failed to read ChipID from lockdownd: %w", err)
+	}
+	ecid, err = lc.GetValueUint64("UniqueChipID", "ECID")
+	if err != nil {
+		return 0, 0, 0, "", fmt.Errorf("failed to read ECID from lockdownd: %w", err)
+	}
+
+	mc, err := mobileimagemounter.NewClient(udid)
+	if err != nil {
+		return 0, 0, 0, "", fmt.Errorf("failed to connect to mobile_image_mounter: %w", err)
+	}
+	defer mc.Close()
+
+	nonceData, err := mc.QueryPersonalizationNonce("Personalized")
+	if err != nil {
+		return 0, 0, 0, "", fmt.Errorf("failed to query personalization nonce: %w", err)
+	}
+
+	return boardID, chipID, ecid, fmt.Sprintf("%x", nonceData), nil
+}
+
+// defaultDeviceUDID picks the UDID to auto-discover personalization parameters from
+// when --udid wasn't given, by looking for the single device attached over USB.
+func defaultDeviceUDID() (string, error) {
+	devices, err := usb.Devices()
+	if err != nil {
+		return "", fmt.Errorf("failed to list attached devices: %w", err)
+	}
+	switch len(devices) {
+	case 0:
+		return "", fmt.Errorf("no attached devices found")
+	case 1:
+		return devices[0].UDID, nil
+	default:
+		return "", fmt.Errorf("multiple devices attached, use --udid to pick one")
+	}
+}
+
+// mountPersonalizedDDI uploads the DDI at dmgPath to the device identified by udid and
+// asks MobileImageMounter to mount it using the freshly obtained signature. For
+// CoreDevice DDIs the Image.dmg.trustcache and BuildManifest.plist that ship alongside
+// the DMG are uploaded too, since the device requires them to validate the mount.
+func mountPersonalizedDDI(udid, dmgPath string, signature []byte) error {
+	mc, err := mobileimagemounter.NewClient(udid)
+	if err != nil {
+		return fmt.Errorf("failed to connect to mobile_image_mounter: %w", err)
+	}
+	defer mc.Close()
+
+	utils.Indent(log.Info, 2)(fmt.Sprintf("Uploading %s to device %s", filepath.Base(dmgPath), udid))
+	if err := mc.ReceiveBytes(dmgPath); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", dmgPath, err)
+	}
+
+	mountCfg := &mobileimagemounter.MountConfig{
+		ImageType: "Personalized",
+		Signature: signature,
+	}
+
+	trustCachePath := filepath.Join(filepath.Dir(dmgPath), "Image.dmg.trustcache")
+	if data, err := os.ReadFile(trustCachePath); err == nil {
+		mountCfg.TrustCache = data
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read %s: %w", trustCachePath, err)
+	}
+
+	coreDeviceManifestPath := filepath.Join(filepath.Dir(dmgPath), "BuildManifest.plist")
+	if data, err := os.ReadFile(coreDeviceManifestPath); err == nil {
+		mountCfg.BuildManifest = data
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read %s: %w", coreDeviceManifestPath, err)
+	}
+
+	utils.Indent(log.Info, 2)("Mounting personalized DDI on device")
+	if err := mc.MountImage(mountCfg); err != nil {
+		return fmt.Errorf("failed to mount DDI: %w", err)
+	}
+
+	return nil
+}
+
+// personalizeWithCache returns the TSS personalization signature for (boardID, chipID,
+// ecid, nonce, buildID), reusing a cached ticket unless refresh is set. A freshly
+// obtained signature is written back to the cache, alongside manifestDigest (the
+// identity digest of the BuildManifest.plist used), before being returned.
+func personalizeWithCache(cache *tss.Cache, buildManifest *plist.BuildManifest, proxy string, insecure bool, boardID, chipID, ecid uint64, nonce, buildID, manifestDigest string, refresh bool) ([]byte, error) {
+	if !refresh {
+		if cached, entry, err := cache.Get(boardID, chipID, ecid, nonce, buildID); err == nil {
+			utils.Indent(log.Info, 2)(fmt.Sprintf("Reusing cached TSS ticket from %s for board=%#x chip=%#x ecid=%d (pass --refresh to force re-signing)",
+				entry.CreatedAt.Format(time.RFC3339), boardID, chipID, ecid))
+			return cached, nil
+		} else if !errors.Is(err, tss.ErrCacheMiss) {
+			return nil, fmt.Errorf("failed to read tss cache: %w", err)
+		}
+	}
+
+	sigData, err := tss.Personalize(&tss.PersonalConfig{
+		Proxy:    proxy,
+		Insecure: insecure,
+		PersonlID: map[string]any{
+			"BoardId":      boardID,
+			"ChipID":       chipID,
+			"UniqueChipID": ecid,
+		},
+		BuildManifest: buildManifest,
+		Nonce:         nonce,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to personalize DDI: %w", err)
+	}
+
+	if err := cache.Put(&tss.CacheEntry{
+		BoardID:        boardID,
+		ChipID:         chipID,
+		ECID:           ecid,
+		Nonce:          nonce,
+		BuildID:        buildID,
+		ManifestDigest: manifestDigest,
+	}, sigData); err != nil {
+		log.Errorf("failed to cache TSS ticket for board=%#x chip=%#x ecid=%d: %v", boardID, chipID, ecid, err)
+	}
+
+	return sigData, nil
 }
 
 // idevImgSignCmd represents the sign command
@@ -78,22 +232,53 @@ var idevImgSignCmd = &cobra.Command{
 		// flags
 		xcode := viper.GetString("idev.img.sign.xcode")
 		manifestPath := viper.GetString("idev.img.sign.manifest")
+		udid := viper.GetString("idev.img.sign.udid")
 		boardID := viper.GetUint64("idev.img.sign.board-id")
 		chipID := viper.GetUint64("idev.img.sign.chip-id")
 		ecid := viper.GetUint64("idev.img.sign.ecid")
 		nonce := viper.GetString("idev.img.sign.nonce")
 		output := viper.GetString("idev.img.sign.output")
+		noMount := viper.GetBool("idev.img.sign.no-mount")
+		devices := viper.GetString("idev.img.sign.devices")
 		// verify flags
 		if xcode != "" && manifestPath != "" {
 			return fmt.Errorf("cannot specify both --xcode and --manifest")
 		} else if xcode == "" && manifestPath == "" {
 			return fmt.Errorf("must specify either --xcode or --manifest")
-		} else if boardID == 0 || chipID == 0 || ecid == 0 || nonce == "" {
-			return fmt.Errorf("must specify --board-id, --chip-id, --ecid AND --nonce")
 		}
 
+		// auto-discover personalization params from an attached device, falling back
+		// to whatever was explicitly passed on the command line as an override
+		if devices == "" && (boardID == 0 || chipID == 0 || ecid == 0 || nonce == "") {
+			if udid == "" {
+				defaultUDID, err := defaultDeviceUDID()
+				if err != nil {
+					return fmt.Errorf("must specify --board-id, --chip-id, --ecid AND --nonce (or --udid to auto-discover them, or --devices to read them from a file): %w", err)
+				}
+				udid = defaultUDID
+			}
+			utils.Indent(log.Info, 2)(fmt.Sprintf("Querying device %s for personalization parameters", udid))
+			dBoardID, dChipID, dECID, dNonce, err := queryDevicePersonalization(udid)
+			if err != nil {
+				return fmt.Errorf("failed to auto-discover personalization parameters: %w", err)
+			}
+			if boardID == 0 {
+				boardID = dBoardID
+			}
+			if chipID == 0 {
+				chipID = dChipID
+			}
+			if ecid == 0 {
+				ecid = dECID
+			}
+			if nonce == "" {
+				nonce = dNonce
+			}
+		}
+
+		var dmgPath string
 		if xcode != "" {
-			dmgPath := filepath.Join(xcode, "/Contents/Resources/CoreDeviceDDIs/iOS_DDI.dmg")
+			dmgPath = filepath.Join(xcode, "/Contents/Resources/CoreDeviceDDIs/iOS_DDI.dmg")
 			if _, err := os.Stat(dmgPath); errors.Is(err, os.ErrNotExist) {
 				return fmt.Errorf("failed to find iOS_DDI.dmg in '%s' (install NEW XCode.app or Xcode-beta.app)", xcode)
 			}
@@ -126,19 +311,25 @@ var idevImgSignCmd = &cobra.Command{
 			return fmt.Errorf("failed to parse BuildManifest.plist: %w", err)
 		}
 
-		sigData, err := tss.Personalize(&tss.PersonalConfig{
-			Proxy:    viper.GetString("idev.img.sign.proxy"),
-			Insecure: viper.GetBool("idev.img.sign.insecure"),
-			PersonlID: map[string]any{
-				"BoardId":      boardID,
-				"ChipID":       chipID,
-				"UniqueChipID": ecid,
-			},
-			BuildManifest: buildManifest,
-			Nonce:         nonce,
-		})
+		cacheDir, err := tss.DefaultCacheDir()
 		if err != nil {
-			return fmt.Errorf("failed to personalize DDI: %w", err)
+			return fmt.Errorf("failed to resolve tss cache dir: %w", err)
+		}
+		cache, err := tss.NewCache(cacheDir)
+		if err != nil {
+			return fmt.Errorf("failed to open tss cache: %w", err)
+		}
+		buildID := buildManifest.ProductBuildVersion
+		manifestDigest := fmt.Sprintf("%x", sha256.Sum256(manifestData))
+
+		if devices != "" {
+			return signDeviceBatch(devices, dmgPath, buildManifest, manifestDigest, cache, output)
+		}
+
+		sigData, err := personalizeWithCache(cache, buildManifest, viper.GetString("idev.img.sign.proxy"), viper.GetBool("idev.img.sign.insecure"),
+			boardID, chipID, ecid, nonce, buildID, manifestDigest, viper.GetBool("idev.img.sign.refresh"))
+		if err != nil {
+			return err
 		}
 
 		fname := fmt.Sprintf("%d.%d.%d.%s", boardID, chipID, ecid, "personalized.signature")
@@ -154,6 +345,17 @@ var idevImgSignCmd = &cobra.Command{
 			return fmt.Errorf("failed to write signature to %s: %w", output, err)
 		}
 
-		return nil
+		if noMount {
+			return nil
+		}
+		if udid == "" {
+			log.Warn("skipping mount: --udid not specified (pass --no-mount to silence this warning)")
+			return nil
+		}
+		if dmgPath == "" {
+			return fmt.Errorf("--udid requires --xcode so the DDI image to mount is known (use --no-mount for sign-only)")
+		}
+
+		return mountPersonalizedDDI(udid, dmgPath, sigData)
 	},
 }
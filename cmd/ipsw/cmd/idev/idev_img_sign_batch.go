@@ -0,0 +1,205 @@
+/*
+Copyright © 2023 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package idev
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/blacktop/ipsw/internal/utils"
+	"github.com/blacktop/ipsw/pkg/plist"
+	"github.com/blacktop/ipsw/pkg/tss"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// batchMaxWorkers bounds how many devices are personalized concurrently, so a large
+// fleet file doesn't open hundreds of simultaneous TSS connections at once.
+const batchMaxWorkers = 8
+
+// batchMaxAttempts is how many times in total (the first try included) a device's TSS
+// request is attempted before the batch gives up on it.
+const batchMaxAttempts = 4
+
+// batchRetryBaseDelay is the delay before the first retry of a failed TSS request; it
+// doubles on every subsequent attempt, so a batch of dozens of devices backs off a
+// struggling TSS server instead of hammering it at a fixed rate.
+const batchRetryBaseDelay = 2 * time.Second
+
+// retryTSSWithBackoff calls fn until it succeeds, at most maxAttempts times in total,
+// doubling the delay between attempts starting at baseDelay.
+func retryTSSWithBackoff(maxAttempts int, baseDelay time.Duration, fn func() error) error {
+	var err error
+	delay := baseDelay
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt == maxAttempts {
+			break
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	return err
+}
+
+// BatchDevice is one entry of a --devices fleet file.
+type BatchDevice struct {
+	BoardID uint64 `json:"board-id" yaml:"board-id"`
+	ChipID  uint64 `json:"chip-id" yaml:"chip-id"`
+	ECID    uint64 `json:"ecid" yaml:"ecid"`
+	Nonce   string `json:"nonce" yaml:"nonce"`
+	UDID    string `json:"udid,omitempty" yaml:"udid,omitempty"`
+	Output  string `json:"output,omitempty" yaml:"output,omitempty"`
+}
+
+// loadBatchDevices parses a --devices fleet file, dispatching on its extension.
+func loadBatchDevices(path string) ([]BatchDevice, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read devices file '%s': %w", path, err)
+	}
+
+	var devices []BatchDevice
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		if err := json.Unmarshal(data, &devices); err != nil {
+			return nil, fmt.Errorf("failed to parse devices file '%s' as JSON: %w", path, err)
+		}
+	default:
+		if err := yaml.Unmarshal(data, &devices); err != nil {
+			return nil, fmt.Errorf("failed to parse devices file '%s' as YAML: %w", path, err)
+		}
+	}
+
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("devices file '%s' contains no entries", path)
+	}
+
+	return devices, nil
+}
+
+// signDeviceBatch personalizes every device in a fleet file concurrently, through a
+// bounded worker pool with retries around transient TSS failures, writing one
+// `<board>.<chip>.<ecid>.personalized.signature` per entry. The DDI referenced by
+// dmgPath (if any) has already been mounted once by the caller for the whole batch;
+// unless --no-mount is set, entries that specify a udid additionally get that DDI
+// mounted on their own device.
+func signDeviceBatch(devicesPath, dmgPath string, buildManifest *plist.BuildManifest, manifestDigest string, cache *tss.Cache, output string) error {
+	devices, err := loadBatchDevices(devicesPath)
+	if err != nil {
+		return err
+	}
+
+	buildID := buildManifest.ProductBuildVersion
+	proxy := viper.GetString("idev.img.sign.proxy")
+	insecure := viper.GetBool("idev.img.sign.insecure")
+	refresh := viper.GetBool("idev.img.sign.refresh")
+	noMount := viper.GetBool("idev.img.sign.no-mount")
+
+	log.Infof("Personalizing %d device(s) from %s", len(devices), devicesPath)
+
+	var (
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, batchMaxWorkers)
+		mu       sync.Mutex
+		failures []error
+	)
+
+	for i := range devices {
+		dev := devices[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			var sigData []byte
+			err := retryTSSWithBackoff(batchMaxAttempts, batchRetryBaseDelay, func() error {
+				var err error
+				sigData, err = personalizeWithCache(cache, buildManifest, proxy, insecure, dev.BoardID, dev.ChipID, dev.ECID, dev.Nonce, buildID, manifestDigest, refresh)
+				return err
+			})
+			if err != nil {
+				mu.Lock()
+				failures = append(failures, fmt.Errorf("board=%#x chip=%#x ecid=%d: %w", dev.BoardID, dev.ChipID, dev.ECID, err))
+				mu.Unlock()
+				return
+			}
+
+			out := dev.Output
+			if out == "" {
+				out = output
+			}
+			fname := fmt.Sprintf("%d.%d.%d.%s", dev.BoardID, dev.ChipID, dev.ECID, "personalized.signature")
+			if out != "" {
+				if err := os.MkdirAll(out, 0750); err != nil {
+					mu.Lock()
+					failures = append(failures, fmt.Errorf("board=%#x chip=%#x ecid=%d: failed to create output folder '%s': %w", dev.BoardID, dev.ChipID, dev.ECID, out, err))
+					mu.Unlock()
+					return
+				}
+				fname = filepath.Join(out, fname)
+			}
+
+			utils.Indent(log.Info, 2)(fmt.Sprintf("Writing signature to %s", fname))
+			if err := os.WriteFile(fname, sigData, 0644); err != nil {
+				mu.Lock()
+				failures = append(failures, fmt.Errorf("board=%#x chip=%#x ecid=%d: failed to write signature to %s: %w", dev.BoardID, dev.ChipID, dev.ECID, fname, err))
+				mu.Unlock()
+				return
+			}
+
+			if dev.UDID != "" && !noMount {
+				if dmgPath == "" {
+					mu.Lock()
+					failures = append(failures, fmt.Errorf("board=%#x chip=%#x ecid=%d: udid %s requires --xcode so the DDI image to mount is known", dev.BoardID, dev.ChipID, dev.ECID, dev.UDID))
+					mu.Unlock()
+					return
+				}
+				if err := mountPersonalizedDDI(dev.UDID, dmgPath, sigData); err != nil {
+					mu.Lock()
+					failures = append(failures, fmt.Errorf("board=%#x chip=%#x ecid=%d: %w", dev.BoardID, dev.ChipID, dev.ECID, err))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if len(failures) > 0 {
+		for _, ferr := range failures {
+			log.Error(ferr.Error())
+		}
+		return fmt.Errorf("failed to personalize %d of %d device(s)", len(failures), len(devices))
+	}
+
+	return nil
+}
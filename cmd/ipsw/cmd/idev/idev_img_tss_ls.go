@@ -0,0 +1,77 @@
+/*
+Copyright © 2023 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package idev
+
+import (
+	"fmt"
+
+	"github.com/apex/log"
+	"github.com/blacktop/ipsw/pkg/tss"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	idevImgTssCmd.AddCommand(idevImgTssLsCmd)
+}
+
+// idevImgTssLsCmd represents the tss ls command
+var idevImgTssLsCmd = &cobra.Command{
+	Use:           "ls",
+	Short:         "List cached TSS tickets",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if viper.GetBool("verbose") {
+			log.SetLevel(log.DebugLevel)
+		}
+		color.NoColor = !viper.GetBool("color")
+
+		cacheDir, err := tss.DefaultCacheDir()
+		if err != nil {
+			return fmt.Errorf("failed to resolve tss cache dir: %w", err)
+		}
+		cache, err := tss.NewCache(cacheDir)
+		if err != nil {
+			return fmt.Errorf("failed to open tss cache: %w", err)
+		}
+
+		entries, err := cache.List()
+		if err != nil {
+			return fmt.Errorf("failed to list tss cache: %w", err)
+		}
+
+		if len(entries) == 0 {
+			log.Info("tss cache is empty")
+			return nil
+		}
+
+		for _, entry := range entries {
+			fmt.Printf("%s  board=%#x chip=%#x ecid=%d build=%s nonce=%s manifest=%s\n",
+				entry.CreatedAt.Format("2006-01-02 15:04:05"), entry.BoardID, entry.ChipID, entry.ECID, entry.BuildID, entry.Nonce, entry.ManifestDigest)
+		}
+
+		return nil
+	},
+}
@@ -0,0 +1,73 @@
+/*
+Copyright © 2023 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package idev
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/blacktop/ipsw/pkg/tss"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	idevImgTssCmd.AddCommand(idevImgTssPruneCmd)
+
+	idevImgTssPruneCmd.Flags().Duration("max-age", 30*24*time.Hour, "remove tickets older than this")
+	viper.BindPFlag("idev.img.tss.prune.max-age", idevImgTssPruneCmd.Flags().Lookup("max-age"))
+}
+
+// idevImgTssPruneCmd represents the tss prune command
+var idevImgTssPruneCmd = &cobra.Command{
+	Use:           "prune",
+	Short:         "Garbage-collect cached TSS tickets older than --max-age",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if viper.GetBool("verbose") {
+			log.SetLevel(log.DebugLevel)
+		}
+		color.NoColor = !viper.GetBool("color")
+
+		cacheDir, err := tss.DefaultCacheDir()
+		if err != nil {
+			return fmt.Errorf("failed to resolve tss cache dir: %w", err)
+		}
+		cache, err := tss.NewCache(cacheDir)
+		if err != nil {
+			return fmt.Errorf("failed to open tss cache: %w", err)
+		}
+
+		removed, err := cache.Prune(viper.GetDuration("idev.img.tss.prune.max-age"))
+		if err != nil {
+			return fmt.Errorf("failed to prune tss cache: %w", err)
+		}
+
+		log.Infof("removed %d stale TSS ticket(s)", removed)
+
+		return nil
+	},
+}
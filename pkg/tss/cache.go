@@ -0,0 +1,186 @@
+/*
+Copyright © 2023 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package tss
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ErrCacheMiss is returned by Cache.Get when no entry exists for the given tuple.
+var ErrCacheMiss = errors.New("tss: cache miss")
+
+// CacheEntry is the sidecar manifest written next to every cached personalization
+// signature. It records enough identity information to let `idev img tss ls` explain
+// what a cached blob is for without having to re-parse the TSS response.
+//
+// It does not record the raw TSS request/response bodies: Personalize (pkg/tss) only
+// returns the finished signature, with no hook to capture what it sent or received.
+// Storing those bodies would mean changing that signature, which is out of scope here;
+// ManifestDigest is the identity information we can get at without doing so.
+type CacheEntry struct {
+	Key            string    `json:"key"`
+	BoardID        uint64    `json:"board_id"`
+	ChipID         uint64    `json:"chip_id"`
+	ECID           uint64    `json:"ecid"`
+	Nonce          string    `json:"nonce"`
+	BuildID        string    `json:"build_id"`
+	ManifestDigest string    `json:"manifest_digest"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Cache is a content-addressed store of personalization signatures keyed by
+// (BoardID, ChipID, ECID, Nonce, BuildID), rooted at a directory (by default
+// ~/.ipsw/tss-cache/). Each entry is a pair of files: `<key>.signature` holding the
+// personalization signature returned by Personalize (the one handed to
+// MobileImageMounter), and `<key>.json` holding the CacheEntry manifest.
+type Cache struct {
+	dir string
+}
+
+// DefaultCacheDir returns the default TSS cache location (~/.ipsw/tss-cache).
+func DefaultCacheDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine home directory: %w", err)
+	}
+	return filepath.Join(home, ".ipsw", "tss-cache"), nil
+}
+
+// NewCache opens (creating if necessary) a Cache rooted at dir.
+func NewCache(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create tss cache dir '%s': %w", dir, err)
+	}
+	return &Cache{dir: dir}, nil
+}
+
+// Key returns the content-address for a (BoardID, ChipID, ECID, Nonce, BuildID) tuple.
+func (c *Cache) Key(boardID, chipID, ecid uint64, nonce, buildID string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d:%d:%d:%s:%s", boardID, chipID, ecid, nonce, buildID)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *Cache) manifestPath(key string) string  { return filepath.Join(c.dir, key+".json") }
+func (c *Cache) signaturePath(key string) string { return filepath.Join(c.dir, key+".signature") }
+
+// Get returns the cached signature and its manifest for the given tuple, or
+// ErrCacheMiss if nothing has been cached for it yet.
+func (c *Cache) Get(boardID, chipID, ecid uint64, nonce, buildID string) ([]byte, *CacheEntry, error) {
+	key := c.Key(boardID, chipID, ecid, nonce, buildID)
+
+	entryData, err := os.ReadFile(c.manifestPath(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, ErrCacheMiss
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("failed to read cache manifest for %s: %w", key, err)
+	}
+	var entry CacheEntry
+	if err := json.Unmarshal(entryData, &entry); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse cache manifest for %s: %w", key, err)
+	}
+
+	sigData, err := os.ReadFile(c.signaturePath(key))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read cached signature for %s: %w", key, err)
+	}
+
+	return sigData, &entry, nil
+}
+
+// Put stores a signature and its manifest under the tuple's content-address,
+// overwriting any prior entry.
+func (c *Cache) Put(entry *CacheEntry, signature []byte) error {
+	entry.Key = c.Key(entry.BoardID, entry.ChipID, entry.ECID, entry.Nonce, entry.BuildID)
+	entry.CreatedAt = time.Now()
+
+	if err := os.WriteFile(c.signaturePath(entry.Key), signature, 0644); err != nil {
+		return fmt.Errorf("failed to write cached signature for %s: %w", entry.Key, err)
+	}
+
+	entryData, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache manifest for %s: %w", entry.Key, err)
+	}
+	if err := os.WriteFile(c.manifestPath(entry.Key), entryData, 0644); err != nil {
+		return fmt.Errorf("failed to write cache manifest for %s: %w", entry.Key, err)
+	}
+
+	return nil
+}
+
+// List returns every manifest currently in the cache, most recently created first.
+func (c *Cache) List() ([]*CacheEntry, error) {
+	matches, err := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tss cache: %w", err)
+	}
+
+	var entries []*CacheEntry
+	for _, m := range matches {
+		data, err := os.ReadFile(m)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cache manifest '%s': %w", m, err)
+		}
+		var entry CacheEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, fmt.Errorf("failed to parse cache manifest '%s': %w", m, err)
+		}
+		entries = append(entries, &entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].CreatedAt.After(entries[j].CreatedAt) })
+
+	return entries, nil
+}
+
+// Prune removes every cached entry older than maxAge, returning the number removed.
+func (c *Cache) Prune(maxAge time.Duration) (int, error) {
+	entries, err := c.List()
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-maxAge)
+	var removed int
+	for _, entry := range entries {
+		if entry.CreatedAt.After(cutoff) {
+			continue
+		}
+		if err := os.Remove(c.signaturePath(entry.Key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, fmt.Errorf("failed to remove cached signature for %s: %w", entry.Key, err)
+		}
+		if err := os.Remove(c.manifestPath(entry.Key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, fmt.Errorf("failed to remove cache manifest for %s: %w", entry.Key, err)
+		}
+		removed++
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,119 @@
+/*
+Copyright © 2023 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package tss
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCacheGetMiss(t *testing.T) {
+	cache, err := NewCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewCache() error = %v", err)
+	}
+
+	if _, _, err := cache.Get(0x1, 0x2, 3, "nonce", "build"); !errors.Is(err, ErrCacheMiss) {
+		t.Fatalf("Get() error = %v, want ErrCacheMiss", err)
+	}
+}
+
+func TestCachePutGetRoundTrip(t *testing.T) {
+	cache, err := NewCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewCache() error = %v", err)
+	}
+
+	entry := &CacheEntry{
+		BoardID:        0x1,
+		ChipID:         0x2,
+		ECID:           3,
+		Nonce:          "nonce",
+		BuildID:        "build",
+		ManifestDigest: "digest",
+	}
+	want := []byte("signature bytes")
+
+	if err := cache.Put(entry, want); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	got, gotEntry, err := cache.Get(entry.BoardID, entry.ChipID, entry.ECID, entry.Nonce, entry.BuildID)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("Get() signature = %q, want %q", got, want)
+	}
+	if gotEntry.ManifestDigest != entry.ManifestDigest {
+		t.Errorf("Get() manifest digest = %q, want %q", gotEntry.ManifestDigest, entry.ManifestDigest)
+	}
+	if gotEntry.Key != cache.Key(entry.BoardID, entry.ChipID, entry.ECID, entry.Nonce, entry.BuildID) {
+		t.Errorf("Get() key = %q, want %q", gotEntry.Key, cache.Key(entry.BoardID, entry.ChipID, entry.ECID, entry.Nonce, entry.BuildID))
+	}
+}
+
+func TestCachePrune(t *testing.T) {
+	cache, err := NewCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewCache() error = %v", err)
+	}
+
+	stale := &CacheEntry{BoardID: 0x1, ChipID: 0x1, ECID: 1, Nonce: "stale", BuildID: "build"}
+	fresh := &CacheEntry{BoardID: 0x2, ChipID: 0x2, ECID: 2, Nonce: "fresh", BuildID: "build"}
+
+	if err := cache.Put(stale, []byte("stale")); err != nil {
+		t.Fatalf("Put(stale) error = %v", err)
+	}
+	if err := cache.Put(fresh, []byte("fresh")); err != nil {
+		t.Fatalf("Put(fresh) error = %v", err)
+	}
+
+	// Put always stamps CreatedAt with time.Now(), so backdate the stale entry's
+	// manifest directly to exercise Prune's age cutoff.
+	stale.CreatedAt = time.Now().Add(-48 * time.Hour)
+	staleData, err := json.MarshalIndent(stale, "", "  ")
+	if err != nil {
+		t.Fatalf("MarshalIndent(stale) error = %v", err)
+	}
+	if err := os.WriteFile(cache.manifestPath(stale.Key), staleData, 0644); err != nil {
+		t.Fatalf("WriteFile(stale manifest) error = %v", err)
+	}
+
+	removed, err := cache.Prune(24 * time.Hour)
+	if err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	if removed != 1 {
+		t.Fatalf("Prune() removed = %d, want 1", removed)
+	}
+
+	if _, _, err := cache.Get(stale.BoardID, stale.ChipID, stale.ECID, stale.Nonce, stale.BuildID); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("Get(stale) error = %v, want ErrCacheMiss", err)
+	}
+	if _, _, err := cache.Get(fresh.BoardID, fresh.ChipID, fresh.ECID, fresh.Nonce, fresh.BuildID); err != nil {
+		t.Errorf("Get(fresh) error = %v, want nil", err)
+	}
+}